@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	cli "github.com/urfave/cli/v2"
 
@@ -12,6 +16,10 @@ import (
 	"github.com/Ehco1996/ehco/internal/web"
 )
 
+// graceShutdownTimeout bounds how long SIGTERM/SIGINT waits for in-flight
+// streams to drain before forcing every relay closed.
+const graceShutdownTimeout = 10 * time.Second
+
 var LocalAddr string
 var ListenType string
 var RemoteAddr string
@@ -114,7 +122,9 @@ func start(ctx *cli.Context) error {
 	}
 
 	initTls := false
+	relays := make([]*relay.Relay, 0, len(config.Configs))
 	for _, cfg := range config.Configs {
+		cfg := cfg
 		if !initTls && (cfg.ListenType == constant.Listen_WSS ||
 			cfg.ListenType == constant.Listen_MWSS ||
 			cfg.TransportType == constant.Transport_WSS ||
@@ -122,15 +132,33 @@ func start(ctx *cli.Context) error {
 			initTls = true
 			tls.InitTlsCfg()
 		}
-		go serveRelay(cfg, ch)
+		r, err := relay.NewRelay(&cfg)
+		if err != nil {
+			logger.Logger.Fatal(err)
+		}
+		relays = append(relays, r)
+		go serveRelay(r, ch)
 	}
-	return <-ch
-}
 
-func serveRelay(cfg relay.RelayConfig, ch chan error) {
-	r, err := relay.NewRelay(&cfg)
-	if err != nil {
-		logger.Logger.Fatal(err)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-ch:
+		return err
+	case <-sigCh:
+		logger.Logger.Info("received shutdown signal, draining in-flight streams before exit")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), graceShutdownTimeout)
+		defer cancel()
+		for _, r := range relays {
+			if err := r.Shutdown(shutdownCtx); err != nil {
+				logger.Logger.Infof("relay shutdown err: %s", err)
+			}
+		}
+		return nil
 	}
+}
+
+func serveRelay(r *relay.Relay, ch chan error) {
 	ch <- r.ListenAndServe()
 }
@@ -0,0 +1,56 @@
+package constant
+
+import "time"
+
+const Version = "1.0.0"
+
+const (
+	DialTimeOut      = 5 * time.Second
+	MaxMWSSStreamCnt = 50
+)
+
+// listen types
+const (
+	Listen_RAW  = "raw"
+	Listen_WS   = "ws"
+	Listen_WSS  = "wss"
+	Listen_MWSS = "mwss"
+	Listen_GRPC = "grpc"
+)
+
+// transport types
+const (
+	Transport_RAW  = "raw"
+	Transport_WS   = "ws"
+	Transport_WSS  = "wss"
+	Transport_MWSS = "mwss"
+	// Transport_MWSS_UOT tunnels UDP over an mwss smux stream, framing each
+	// datagram with a GlobalID so a long-lived UDP flow can migrate to a new
+	// stream (new TCP session, new network) without the remote peer seeing a
+	// new 5-tuple. See internal/transporter/uot.go.
+	Transport_MWSS_UOT = "mwss_uot"
+)
+
+// MuxScope scopes smux multiplexing to a single inner protocol, mirroring the
+// MultiplexingConfig.Only knob used by v2ray-family cores.
+type MuxScope int
+
+const (
+	// MuxScopeBoth muxes both TCP and UDP traffic over the same smux session (default).
+	MuxScopeBoth MuxScope = iota
+	// MuxScopeTCP only muxes TCP traffic; UDP gets its own ws conn per flow.
+	MuxScopeTCP
+	// MuxScopeUDP only muxes UDP traffic; TCP gets its own ws conn per flow.
+	MuxScopeUDP
+)
+
+func (s MuxScope) Allows(proto string) bool {
+	switch s {
+	case MuxScopeTCP:
+		return proto == "tcp"
+	case MuxScopeUDP:
+		return proto == "udp"
+	default:
+		return true
+	}
+}
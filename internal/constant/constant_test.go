@@ -0,0 +1,24 @@
+package constant
+
+import "testing"
+
+func TestMuxScopeAllows(t *testing.T) {
+	cases := []struct {
+		scope MuxScope
+		proto string
+		want  bool
+	}{
+		{MuxScopeBoth, "tcp", true},
+		{MuxScopeBoth, "udp", true},
+		{MuxScopeTCP, "tcp", true},
+		{MuxScopeTCP, "udp", false},
+		{MuxScopeUDP, "udp", true},
+		{MuxScopeUDP, "tcp", false},
+	}
+
+	for _, c := range cases {
+		if got := c.scope.Allows(c.proto); got != c.want {
+			t.Errorf("MuxScope(%d).Allows(%q) = %v, want %v", c.scope, c.proto, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+)
+
+// RelayConfig describes a single relay instance, typically one element of
+// Config.Configs loaded from the config file, or synthesized from CLI flags.
+type RelayConfig struct {
+	Listen        string   `json:"listen"`
+	ListenType    string   `json:"listen_type"`
+	TCPRemotes    []string `json:"tcp_remotes"`
+	UDPRemotes    []string `json:"udp_remotes"`
+	TransportType string   `json:"transport_type"`
+
+	// MuxOnly scopes smux multiplexing to a single inner protocol when the
+	// listen/transport type is mwss. Zero value (constant.MuxScopeBoth) keeps
+	// the historical behaviour of muxing everything.
+	MuxOnly constant.MuxScope `json:"mux_only"`
+
+	// SessionPool knobs for mwss/mwss_uot transports. Zero values fall back
+	// to transporter.DefaultSessionPoolConfig.
+	MinIdle              int `json:"min_idle"`
+	MaxIdle              int `json:"max_idle"`
+	MaxStreamsPerSession int `json:"max_streams_per_session"`
+}
+
+// Config is the top level config file shape, a list of RelayConfig.
+type Config struct {
+	PATH    string        `json:"-"`
+	Configs []RelayConfig `json:"configs"`
+}
+
+func NewConfigByPath(path string) *Config {
+	return &Config{PATH: path}
+}
+
+func (c *Config) LoadConfig() error {
+	f, err := os.Open(c.PATH)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(c)
+}
@@ -0,0 +1,378 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/logger"
+	"github.com/Ehco1996/ehco/internal/transporter"
+)
+
+// transporterNameFor maps a RelayConfig's TransportType to the name it's
+// registered under in the transporter registry. Transport_MWSS_UOT reuses
+// the "mwss" backend: the UDP accept loop calls transporter.DialUoT, which
+// wraps the conn from Transporter.Dial in UoT framing.
+func transporterNameFor(transportType string) string {
+	switch transportType {
+	case constant.Transport_MWSS, constant.Transport_MWSS_UOT:
+		return "mwss"
+	case "":
+		return "raw"
+	default:
+		return transportType
+	}
+}
+
+// Relay wires a listener to one or more remotes through a registered
+// Transporter, looked up by name instead of a hard-coded string switch so
+// new backends (gRPC, QUIC, ...) can be added without touching this file.
+type Relay struct {
+	cfg *RelayConfig
+	tr  transporter.Transporter
+
+	// remoteCursor is the shared round-robin index into cfg.TCPRemotes /
+	// cfg.UDPRemotes, advanced atomically since both the TCP accept loop and
+	// the UDP read loop can pick a remote concurrently.
+	remoteCursor uint64
+
+	// tcpLn/udpConn/mwssSrv/grpcSrv are only set by whichever of
+	// listenRaw/listenMWSS/listenGRPC this relay's ListenType dispatched to;
+	// Shutdown closes whichever of them this relay actually opened.
+	tcpLn   net.Listener
+	udpConn net.PacketConn
+	mwssSrv *transporter.MWSSServer
+	grpcSrv *transporter.GRPCServer
+}
+
+func NewRelay(cfg *RelayConfig) (*Relay, error) {
+	tr, err := transporter.New(transporterNameFor(cfg.TransportType), transporter.Options{
+		MuxOnly: cfg.MuxOnly,
+		Pool: transporter.SessionPoolConfig{
+			MinIdle:              cfg.MinIdle,
+			MaxIdle:              cfg.MaxIdle,
+			MaxStreamsPerSession: cfg.MaxStreamsPerSession,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Relay{cfg: cfg, tr: tr}, nil
+}
+
+// ListenAndServe accepts on r.cfg.Listen per r.cfg.ListenType and dispatches
+// each accepted conn to r.cfg.TCPRemotes / r.cfg.UDPRemotes through r.tr.
+func (r *Relay) ListenAndServe() error {
+	switch r.cfg.ListenType {
+	case constant.Listen_MWSS:
+		return r.listenMWSS()
+	case constant.Listen_GRPC:
+		return r.listenGRPC()
+	case constant.Listen_RAW, "":
+		return r.listenRaw()
+	default:
+		return fmt.Errorf("relay: unsupported listen type %q", r.cfg.ListenType)
+	}
+}
+
+// nextRemote round-robins across remotes so a relay with several TCPRemotes
+// or UDPRemotes spreads load instead of always hitting the first one.
+func (r *Relay) nextRemote(remotes []string) (string, error) {
+	if len(remotes) == 0 {
+		return "", fmt.Errorf("relay: no remotes configured for listener %s", r.cfg.Listen)
+	}
+	i := atomic.AddUint64(&r.remoteCursor, 1)
+	return remotes[i%uint64(len(remotes))], nil
+}
+
+// listenRaw accepts plain TCP conns and UDP datagrams on cfg.Listen and
+// relays each to a remote dialed through r.tr. It's the listen side used by
+// the historical "raw" listen type (and the default when ListenType is
+// unset).
+func (r *Relay) listenRaw() error {
+	errCh := make(chan error, 2)
+	started := false
+
+	if len(r.cfg.TCPRemotes) > 0 {
+		ln, err := net.Listen("tcp", r.cfg.Listen)
+		if err != nil {
+			return err
+		}
+		r.tcpLn = ln
+		started = true
+		go func() { errCh <- r.acceptTCP(ln) }()
+	}
+
+	if len(r.cfg.UDPRemotes) > 0 {
+		pc, err := net.ListenPacket("udp", r.cfg.Listen)
+		if err != nil {
+			return err
+		}
+		r.udpConn = pc
+		started = true
+		go func() { errCh <- r.acceptUDP(pc) }()
+	}
+
+	if !started {
+		return fmt.Errorf("relay: %s has neither TCPRemotes nor UDPRemotes configured", r.cfg.Listen)
+	}
+	return <-errCh
+}
+
+func (r *Relay) acceptTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go r.relayTCP(conn)
+	}
+}
+
+func (r *Relay) relayTCP(local net.Conn) {
+	defer local.Close()
+
+	remote, err := r.nextRemote(r.cfg.TCPRemotes)
+	if err != nil {
+		logger.Logger.Infof("[relay] %s", err)
+		return
+	}
+	rc, err := r.tr.Dial(remote, "tcp")
+	if err != nil {
+		logger.Logger.Infof("[relay] dial %s err: %s", remote, err)
+		return
+	}
+	defer rc.Close()
+
+	relayBidir(local, rc)
+}
+
+// acceptUDP fans datagrams from a single shared PacketConn out to per-client
+// upstream conns, keyed by client addr, and pumps each upstream's replies
+// back to that client. Sessions live for as long as the upstream conn stays
+// open; there's no idle timeout, matching the raw listener's historically
+// connectionless, best-effort forwarding.
+func (r *Relay) acceptUDP(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		payload := append([]byte(nil), buf[:n]...)
+
+		mu.Lock()
+		rc, ok := sessions[clientAddr.String()]
+		mu.Unlock()
+
+		if !ok {
+			rc, err = r.dialUDPRemote(clientAddr)
+			if err != nil {
+				logger.Logger.Infof("[relay] dial udp remote err: %s", err)
+				continue
+			}
+			mu.Lock()
+			sessions[clientAddr.String()] = rc
+			mu.Unlock()
+			go r.pumpUDPRemoteToClient(pc, clientAddr, rc, sessions, &mu)
+		}
+
+		if _, err := rc.Write(payload); err != nil {
+			logger.Logger.Infof("[relay] write udp remote err: %s", err)
+		}
+	}
+}
+
+// dialUDPRemote picks the next UDP remote and dials it, going through
+// transporter.DialUoT instead of r.tr.Dial when this leg tunnels UDP via
+// UoT, so the flow survives the underlying mwss session reconnecting.
+func (r *Relay) dialUDPRemote(clientAddr net.Addr) (net.Conn, error) {
+	remote, err := r.nextRemote(r.cfg.UDPRemotes)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.cfg.TransportType != constant.Transport_MWSS_UOT {
+		return r.tr.Dial(remote, "udp")
+	}
+
+	src, ok := clientAddr.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("relay: expected *net.UDPAddr client addr, got %T", clientAddr)
+	}
+	dst, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+	return transporter.DialUoT(r.tr, remote, src, dst)
+}
+
+func (r *Relay) pumpUDPRemoteToClient(pc net.PacketConn, clientAddr net.Addr, rc net.Conn, sessions map[string]net.Conn, mu *sync.Mutex) {
+	defer func() {
+		mu.Lock()
+		delete(sessions, clientAddr.String())
+		mu.Unlock()
+		rc.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := rc.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// listenMWSS runs the mwss/mwss_uot listen side: an HTTP server upgrading
+// requests to (optionally smux-muxed) ws conns via MWSSServer, then
+// dispatching each accepted conn to cfg.TCPRemotes/cfg.UDPRemotes the same
+// way listenRaw does. When TransportType is mwss_uot, MWSSServer handles
+// accepted streams as UoT frames itself and never hands them to ConnChan, so
+// dispatchMWSSConn only ever sees plain TCP/UDP-over-ws conns.
+func (r *Relay) listenMWSS() error {
+	connCh := make(chan net.Conn, 128)
+	errCh := make(chan error, 1)
+	r.mwssSrv = &transporter.MWSSServer{
+		ConnChan: connCh,
+		ErrChan:  errCh,
+		MuxOnly:  r.cfg.MuxOnly,
+		UoT:      r.cfg.TransportType == constant.Transport_MWSS_UOT,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", r.mwssSrv.Upgrade)
+	r.mwssSrv.Server = &http.Server{Addr: r.cfg.Listen, Handler: mux}
+
+	go func() {
+		for {
+			conn, err := r.mwssSrv.Accept()
+			if err != nil {
+				return
+			}
+			go r.dispatchMWSSConn(conn)
+		}
+	}()
+
+	if err := r.mwssSrv.Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// listenGRPC runs the "gun" gRPC listen side: a grpc.Server registering the
+// Tun method grpcTransporter's client half dials, dispatching each accepted
+// bidi-stream conn to cfg.TCPRemotes the same way listenRaw does. Like the
+// mwss listener, it doesn't terminate TLS itself here; that's assumed to be
+// handled the same way it is for wss/mwss (see cmd/ehco's tls.InitTlsCfg).
+func (r *Relay) listenGRPC() error {
+	ln, err := net.Listen("tcp", r.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	r.tcpLn = ln
+
+	r.grpcSrv = transporter.NewGRPCServer(nil)
+
+	go func() {
+		for {
+			conn, err := r.grpcSrv.Accept()
+			if err != nil {
+				return
+			}
+			go r.dispatchMWSSConn(conn)
+		}
+	}()
+
+	return r.grpcSrv.Serve(ln)
+}
+
+func (r *Relay) dispatchMWSSConn(local net.Conn) {
+	defer local.Close()
+
+	proto := "tcp"
+	if p, ok := local.(interface{ Proto() string }); ok && p.Proto() != "" {
+		proto = p.Proto()
+	}
+
+	remotes := r.cfg.TCPRemotes
+	if proto == "udp" {
+		remotes = r.cfg.UDPRemotes
+	}
+	remote, err := r.nextRemote(remotes)
+	if err != nil {
+		logger.Logger.Infof("[relay] %s", err)
+		return
+	}
+	rc, err := r.tr.Dial(remote, proto)
+	if err != nil {
+		logger.Logger.Infof("[relay] dial %s err: %s", remote, err)
+		return
+	}
+	defer rc.Close()
+
+	relayBidir(local, rc)
+}
+
+// relayBidir copies in both directions until either side closes, then
+// returns once both copies have stopped.
+func relayBidir(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	<-done
+}
+
+// Shutdown stops accepting new work on whichever listener this relay opened,
+// then drains in-flight streams (bounded by ctx) on the outbound transporter
+// instead of RSTing them, so a config reload on the config-file path is
+// zero-downtime. It delegates to the transporter's own Shutdown when it
+// supports graceful draining (e.g. mwss), falling back to a plain Close
+// otherwise.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	var firstErr error
+
+	if r.mwssSrv != nil {
+		if err := r.mwssSrv.Shutdown(ctx); err != nil {
+			firstErr = err
+		}
+	}
+	if r.grpcSrv != nil {
+		if err := r.grpcSrv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.tcpLn != nil {
+		if err := r.tcpLn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.udpConn != nil {
+		if err := r.udpConn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if gc, ok := r.tr.(transporter.GracefulCloser); ok {
+		if err := gc.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return firstErr
+	}
+	if err := r.tr.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -2,9 +2,12 @@ package transporter
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Ehco1996/ehco/internal/constant"
 	"github.com/Ehco1996/ehco/internal/logger"
@@ -13,13 +16,23 @@ import (
 	"github.com/xtaci/smux"
 )
 
+var errTransporterClosing = errors.New("transporter: shutting down")
+
+// Dialer is implemented by every transport backend the relay can dial
+// through. proto is "tcp" or "udp" so a Dialer that only multiplexes one of
+// them can fall back to a plain, unmuxed connection for the other.
+type Dialer interface {
+	Dial(addr, proto string) (net.Conn, error)
+}
+
 type muxConn struct {
 	net.Conn
 	stream *smux.Stream
+	proto  string
 }
 
-func newMuxConn(conn net.Conn, stream *smux.Stream) *muxConn {
-	return &muxConn{Conn: conn, stream: stream}
+func newMuxConn(conn net.Conn, stream *smux.Stream, proto string) *muxConn {
+	return &muxConn{Conn: conn, stream: stream, proto: proto}
 }
 
 func (c *muxConn) Read(b []byte) (n int, err error) {
@@ -34,10 +47,27 @@ func (c *muxConn) Close() error {
 	return c.stream.Close()
 }
 
+func (c *muxConn) Proto() string { return c.proto }
+
+// protoConn is the unmuxed counterpart to muxConn: the whole ws conn *is*
+// the logical stream, used when MuxScope excludes this conn's protocol.
+type protoConn struct {
+	net.Conn
+	proto string
+}
+
+func (c *protoConn) Proto() string { return c.proto }
+
 type muxSession struct {
 	conn         net.Conn
 	session      *smux.Session
 	maxStreamCnt int
+	proto        string
+
+	// draining is set by SessionPool.Shutdown so Get stops handing out new
+	// streams from this session while whatever streams are already open
+	// finish on their own.
+	draining bool
 }
 
 func (session *muxSession) GetConn() (net.Conn, error) {
@@ -45,7 +75,7 @@ func (session *muxSession) GetConn() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newMuxConn(session.conn, stream), nil
+	return newMuxConn(session.conn, stream, session.proto), nil
 }
 
 func (session *muxSession) Close() error {
@@ -70,103 +100,159 @@ func (session *muxSession) NumStreams() int {
 	return 0
 }
 
+// sessionKey scopes the session pool by both remote addr and inner protocol,
+// since a mux-only-UDP transporter must not hand out a TCP conn over the
+// same smux session (and vice versa).
+type sessionKey struct {
+	addr  string
+	proto string
+}
+
 type mwssTransporter struct {
-	sessions     map[string][]*muxSession
-	sessionMutex sync.Mutex
-	dialer       ws.Dialer
+	muxOnly constant.MuxScope
+	pool    *SessionPool
+	dialer  ws.Dialer
+	closing int32 // atomic bool, set by Shutdown
+}
+
+func NewMWSSTransporter(muxOnly constant.MuxScope) *mwssTransporter {
+	return NewMWSSTransporterWithPoolConfig(muxOnly, SessionPoolConfig{})
 }
 
-func NewMWSSTransporter() *mwssTransporter {
-	return &mwssTransporter{
-		sessions: make(map[string][]*muxSession),
+// NewMWSSTransporterWithPoolConfig lets callers override the session pool's
+// MinIdle/MaxIdle/MaxStreamsPerSession/keepalive knobs, typically sourced
+// from RelayConfig.
+func NewMWSSTransporterWithPoolConfig(muxOnly constant.MuxScope, poolCfg SessionPoolConfig) *mwssTransporter {
+	tr := &mwssTransporter{
+		muxOnly: muxOnly,
 		dialer: ws.Dialer{
 			TLSConfig: mytls.DefaultTLSConfig,
 			Timeout:   constant.DialTimeOut},
 	}
+	tr.pool = NewSessionPool(poolCfg, func(key sessionKey) (*muxSession, error) {
+		return tr.initSession(key.addr, key.proto)
+	})
+	return tr
 }
 
-func (tr *mwssTransporter) Dial(addr string) (conn net.Conn, err error) {
-	tr.sessionMutex.Lock()
-	defer tr.sessionMutex.Unlock()
-
-	var session *muxSession
-	var sessionIndex int
-	var sessions []*muxSession
-	var ok bool
-
-	sessions, ok = tr.sessions[addr]
-	// 找到可以用的session
-	for sessionIndex, session = range sessions {
-		if session.NumStreams() >= session.maxStreamCnt {
-			ok = false
-		} else {
-			ok = true
-			break
-		}
+// Dial returns a conn to addr carrying traffic of the given proto ("tcp" or
+// "udp"). When muxOnly scopes multiplexing to the other protocol, proto is
+// served by a plain ws.Dial instead of a smux stream, so bulk transfers on
+// the unmuxed protocol can't head-of-line block the muxed one.
+func (tr *mwssTransporter) Dial(addr, proto string) (conn net.Conn, err error) {
+	if atomic.LoadInt32(&tr.closing) == 1 {
+		return nil, errTransporterClosing
 	}
 
-	// 删除已经关闭的session
-	if session != nil && session.IsClosed() {
-		logger.Logger.Infof("find closed session %v idx: %d", session, sessionIndex)
-		sessions = append(sessions[:sessionIndex], sessions[sessionIndex+1:]...)
-		ok = false
-	}
-
-	// 创建新的session
-	if !ok {
-		session, err = tr.initSession(addr)
+	if !tr.muxOnly.Allows(proto) {
+		// tag this conn's proto the same way initSession does for muxed
+		// sessions, so MWSSServer.Upgrade reads back the same proto on the
+		// query param instead of defaulting to "" (which relay.dispatchMWSSConn
+		// treats as "tcp") for every unmuxed dial.
+		rc, _, _, err := tr.dialer.Dial(context.TODO(), addr+"?proto="+proto)
 		if err != nil {
 			return nil, err
 		}
-		sessions = append(sessions, session)
-	} else {
-		if len(sessions) > 1 {
-			// close last not used session, but we keep one conn in session pool
-			if lastSession := sessions[len(sessions)-1]; lastSession.NumStreams() == 0 {
-				lastSession.Close()
-			}
-		}
+		return &protoConn{Conn: rc, proto: proto}, nil
+	}
+
+	session, err := tr.pool.Get(sessionKey{addr: addr, proto: proto})
+	if err != nil {
+		return nil, err
 	}
 	cc, err := session.GetConn()
 	if err != nil {
 		session.Close()
 		return nil, err
 	}
-	tr.sessions[addr] = sessions
 	return cc, nil
 }
 
-func (tr *mwssTransporter) initSession(addr string) (*muxSession, error) {
-	rc, _, _, err := tr.dialer.Dial(context.TODO(), addr)
+func (tr *mwssTransporter) Close() error      { return tr.pool.Close() }
+func (tr *mwssTransporter) Name() string      { return "mwss" }
+func (tr *mwssTransporter) Multiplexes() bool { return true }
+
+// Shutdown marks tr as draining so Dial rejects new work, then waits for
+// every pooled session's in-flight streams to finish (bounded by ctx)
+// before closing the sessions, mirroring MWSSServer.Shutdown on the server
+// side so a config reload doesn't RST live connections.
+func (tr *mwssTransporter) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&tr.closing, 1)
+	return tr.pool.Shutdown(ctx)
+}
+
+func (tr *mwssTransporter) initSession(addr, proto string) (*muxSession, error) {
+	// the mux scope is per-session, not per-stream, so tag the whole ws
+	// session with its proto on the wire; MWSSServer.mux reads it back off
+	// the upgrade request to tag the muxConns it hands out.
+	rc, _, _, err := tr.dialer.Dial(context.TODO(), addr+"?proto="+proto)
 	if err != nil {
 		return nil, err
 	}
-	// stream multiplex
+	// stream multiplex; KeepAliveInterval/KeepAliveTimeout let smux itself
+	// detect and close a session that's gone silent, since smux.Session has
+	// no Ping method for checkAll to probe RTT with directly.
 	smuxConfig := smux.DefaultConfig()
+	smuxConfig.KeepAliveInterval = tr.pool.cfg.KeepAliveInterval
+	smuxConfig.KeepAliveTimeout = tr.pool.cfg.KeepAliveTimeout
 	session, err := smux.Client(rc, smuxConfig)
 	if err != nil {
 		return nil, err
 	}
-	logger.Logger.Infof("[mwss] Init new session to: %s", rc.RemoteAddr())
-	return &muxSession{conn: rc, session: session, maxStreamCnt: constant.MaxMWSSStreamCnt}, nil
+	logger.Logger.Infof("[mwss] Init new session to: %s proto: %s", rc.RemoteAddr(), proto)
+	return &muxSession{conn: rc, session: session, maxStreamCnt: tr.pool.cfg.MaxStreamsPerSession, proto: proto}, nil
 }
 
 type MWSSServer struct {
 	Server   *http.Server
 	ConnChan chan net.Conn
 	ErrChan  chan error
+
+	// MuxOnly mirrors mwssTransporter.muxOnly: a conn whose proto (read off
+	// the upgrade request's "proto" query param, set by mwssTransporter.Dial)
+	// falls outside the scope is served unmuxed instead of going through
+	// smux.Server, matching the client's choice not to mux it.
+	MuxOnly constant.MuxScope
+
+	// UoT, when true, treats every accepted smux stream as carrying framed
+	// UDP-over-TCP traffic (see uot.go) instead of handing raw muxConns off
+	// to ConnChan. uot is set at most once (by the first mux() call) and read
+	// from Shutdown's goroutine too, hence the atomic.Pointer instead of a
+	// plain field.
+	UoT     bool
+	uotOnce sync.Once
+	uot     atomic.Pointer[uotServer]
+
+	// closed rejects new Upgrades once Shutdown has started; outstanding
+	// counts conns handed to ConnChan that the upper layer hasn't closed
+	// yet, so Shutdown knows when it's safe to close the HTTP server.
+	closed      int32
+	outstanding int64
 }
 
 func (s *MWSSServer) Upgrade(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	conn, _, _, err := ws.UpgradeHTTP(r, w)
 	if err != nil {
 		logger.Logger.Info(err)
 		return
 	}
-	s.mux(conn)
+
+	proto := r.URL.Query().Get("proto")
+	if !s.MuxOnly.Allows(proto) {
+		// the client dialed this proto unmuxed (plain ws.Dial, no smux
+		// framing); parsing it as smux would desync on the first frame, so
+		// hand the whole conn to ConnChan as a single logical stream.
+		s.deliver(&protoConn{Conn: conn, proto: proto})
+		return
+	}
+	s.mux(conn, proto)
 }
 
-func (s *MWSSServer) mux(conn net.Conn) {
+func (s *MWSSServer) mux(conn net.Conn, proto string) {
 	defer conn.Close()
 
 	smuxConfig := smux.DefaultConfig()
@@ -180,19 +266,48 @@ func (s *MWSSServer) mux(conn net.Conn) {
 	logger.Logger.Infof("[mwss server init] %s  %s", conn.RemoteAddr(), s.Server.Addr)
 	defer logger.Logger.Infof("[mwss server close] %s >-< %s", conn.RemoteAddr(), s.Server.Addr)
 
+	if s.UoT {
+		s.uotOnce.Do(func() { s.uot.Store(newUoTServer()) })
+	}
+
 	for {
 		stream, err := mux.AcceptStream()
 		if err != nil {
 			logger.Logger.Infof("[mwss] accept stream err: %s", err)
 			break
 		}
-		cc := newMuxConn(conn, stream)
-		select {
-		case s.ConnChan <- cc:
-		default:
-			cc.Close()
-			logger.Logger.Infof("[mwss] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
+
+		if atomic.LoadInt32(&s.closed) == 1 {
+			// draining: stop handing out new streams, but let the accept
+			// loop keep running so already-open ones finish naturally.
+			stream.Close()
+			continue
+		}
+
+		if s.UoT {
+			go s.uot.Load().handleStream(stream)
+			continue
 		}
+
+		s.deliver(newMuxConn(conn, stream, proto))
+	}
+}
+
+// deliver hands conn to ConnChan, tracked so Shutdown knows it's
+// outstanding, or closes it if the server is draining or the queue is full.
+func (s *MWSSServer) deliver(conn net.Conn) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		conn.Close()
+		return
+	}
+
+	atomic.AddInt64(&s.outstanding, 1)
+	cc := &trackedConn{Conn: conn, onClose: func() { atomic.AddInt64(&s.outstanding, -1) }}
+	select {
+	case s.ConnChan <- cc:
+	default:
+		cc.Close()
+		logger.Logger.Infof("[mwss] %s: connection queue is full", conn.RemoteAddr())
 	}
 }
 
@@ -207,3 +322,57 @@ func (s *MWSSServer) Accept() (conn net.Conn, err error) {
 func (s *MWSSServer) Close() error {
 	return s.Server.Close()
 }
+
+// Shutdown stops accepting new smux streams, waits (bounded by ctx) for
+// ConnChan to drain, every muxConn already handed out to be closed by the
+// upper layer, and every live UoT binding to finish, then closes the
+// underlying HTTP server. This avoids the RST-everything behaviour of Close,
+// so a SIGTERM-triggered config reload doesn't cut live connections.
+func (s *MWSSServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closed, 1)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.outstanding) > 0 || len(s.ConnChan) > 0 || s.uotLiveBindings() > 0 {
+		select {
+		case <-ctx.Done():
+			return s.Server.Close()
+		case <-ticker.C:
+		}
+	}
+	return s.Server.Shutdown(ctx)
+}
+
+// uotLiveBindings reports how many UoT flows are still being pumped, or 0 if
+// this server was never built with UoT enabled.
+func (s *MWSSServer) uotLiveBindings() int64 {
+	u := s.uot.Load()
+	if u == nil {
+		return 0
+	}
+	return u.liveBindings()
+}
+
+// trackedConn wraps a net.Conn handed out to an upper layer so Close can
+// notify the server it's no longer outstanding, letting Shutdown know when
+// it's safe to tear down.
+type trackedConn struct {
+	net.Conn
+	onClose func()
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// Proto forwards to the wrapped conn's Proto, if it has one (muxConn and
+// protoConn both do), so callers reading off ConnChan can still tell TCP and
+// UDP streams apart after trackedConn's wrapping.
+func (c *trackedConn) Proto() string {
+	if p, ok := c.Conn.(interface{ Proto() string }); ok {
+		return p.Proto()
+	}
+	return ""
+}
@@ -0,0 +1,344 @@
+package transporter
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+
+	"github.com/Ehco1996/ehco/internal/logger"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+)
+
+// bytesCodec marshals/unmarshals gRPC messages as plain []byte, sidestepping
+// protoc-generated types entirely: each stream frame is exactly the bytes
+// the caller wrote. This is the same trick CDN-friendly gRPC tunnels (e.g.
+// xray's "gun" transport) use to carry an arbitrary byte stream over a
+// single bidi-streaming RPC.
+type bytesCodec struct{}
+
+func (bytesCodec) Name() string { return "raw" }
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error) {
+	b := v.(*[]byte)
+	return *b, nil
+}
+
+func (bytesCodec) Unmarshal(data []byte, v interface{}) error {
+	b := v.(*[]byte)
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func init() {
+	encoding.RegisterCodec(bytesCodec{})
+}
+
+const grpcTunMethod = "/ehco.gun.GunService/Tun"
+
+// grpcStreamConn adapts a grpc.ClientStream carrying raw []byte frames to
+// net.Conn, the same way muxConn adapts a smux.Stream.
+type grpcStreamConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream grpc.ClientStream
+	remote net.Addr
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newGRPCStreamConn(ctx context.Context, cancel context.CancelFunc, stream grpc.ClientStream, remote net.Addr) *grpcStreamConn {
+	return &grpcStreamConn{ctx: ctx, cancel: cancel, stream: stream, remote: remote}
+}
+
+func (c *grpcStreamConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 {
+		var frame []byte
+		if err := c.stream.RecvMsg(&frame); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.buf = frame
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *grpcStreamConn) Write(p []byte) (int, error) {
+	frame := append([]byte(nil), p...)
+	if err := c.stream.SendMsg(&frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *grpcStreamConn) Close() error                       { c.cancel(); return nil }
+func (c *grpcStreamConn) LocalAddr() net.Addr                { return nil }
+func (c *grpcStreamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *grpcStreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *grpcStreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *grpcStreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "grpc" }
+func (a grpcAddr) String() string  { return string(a) }
+
+// grpcTransporter dials a gRPC bidi-streaming RPC per conn and relies on
+// HTTP/2 multiplexing (one TCP connection, many concurrent RPCs) instead of
+// an extra smux layer on top. It exists for CDNs that terminate WSS but
+// happily proxy gRPC, e.g. Cloudflare.
+type grpcTransporter struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewGRPCTransporter() *grpcTransporter {
+	return &grpcTransporter{conns: make(map[string]*grpc.ClientConn)}
+}
+
+func (tr *grpcTransporter) clientConnFor(addr string) (*grpc.ClientConn, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if cc, ok := tr.conns[addr]; ok {
+		return cc, nil
+	}
+	cc, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(mytls.DefaultTLSConfig)),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(bytesCodec{}.Name())))
+	if err != nil {
+		return nil, err
+	}
+	tr.conns[addr] = cc
+	return cc, nil
+}
+
+func (tr *grpcTransporter) Dial(addr, proto string) (net.Conn, error) {
+	cc, err := tr.clientConnFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "Tun", ClientStreams: true, ServerStreams: true}, grpcTunMethod)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return newGRPCStreamConn(ctx, cancel, stream, grpcAddr(addr)), nil
+}
+
+func (tr *grpcTransporter) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var firstErr error
+	for addr, cc := range tr.conns {
+		if err := cc.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(tr.conns, addr)
+	}
+	return firstErr
+}
+
+func (tr *grpcTransporter) Name() string      { return "grpc" }
+func (tr *grpcTransporter) Multiplexes() bool { return true }
+
+func init() {
+	Register("grpc", func(Options) Transporter { return NewGRPCTransporter() })
+}
+
+// grpcServerStreamConn is grpcStreamConn's accept-side counterpart: it
+// adapts a grpc.ServerStream carrying raw []byte frames to net.Conn.
+type grpcServerStreamConn struct {
+	stream grpc.ServerStream
+	remote net.Addr
+
+	mu  sync.Mutex
+	buf []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newGRPCServerStreamConn(stream grpc.ServerStream, remote net.Addr) *grpcServerStreamConn {
+	return &grpcServerStreamConn{stream: stream, remote: remote, closed: make(chan struct{})}
+}
+
+func (c *grpcServerStreamConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 {
+		var frame []byte
+		if err := c.stream.RecvMsg(&frame); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.buf = frame
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *grpcServerStreamConn) Write(p []byte) (int, error) {
+	frame := append([]byte(nil), p...)
+	if err := c.stream.SendMsg(&frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close signals handleTun to return, ending the RPC; it doesn't tear down
+// the stream itself since a gRPC server handler can only end a stream by
+// returning, not by closing something out from under it.
+func (c *grpcServerStreamConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *grpcServerStreamConn) LocalAddr() net.Addr                { return nil }
+func (c *grpcServerStreamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *grpcServerStreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *grpcServerStreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *grpcServerStreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// gunServiceDesc registers grpcTunMethod as a bidi-streaming RPC without
+// needing protoc-generated service types: HandlerType is unused for
+// streaming methods (grpc only calls gunTunHandler(srv, stream)), so a bare
+// interface{} placeholder is enough, the same trick bytesCodec uses to skip
+// generated message types.
+var gunServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ehco.gun.GunService",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Tun",
+			Handler:       gunTunHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+func gunTunHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*GRPCServer).handleTun(stream)
+}
+
+// GRPCServer is the accept side of the "gun" transport: a grpc.Server
+// registering the same /ehco.gun.GunService/Tun method grpcTransporter
+// dials, handing each accepted bidi stream to ConnChan as a net.Conn so the
+// relay's accept loop can dispatch it exactly like any other transport.
+type GRPCServer struct {
+	Server   *grpc.Server
+	ConnChan chan net.Conn
+	ErrChan  chan error
+
+	closed int32
+}
+
+// NewGRPCServer builds a grpc.Server with the gun service registered.
+// tlsConfig may be nil for a plaintext listener (e.g. behind a CDN/reverse
+// proxy that terminates TLS itself).
+func NewGRPCServer(tlsConfig *stdtls.Config) *GRPCServer {
+	gs := &GRPCServer{
+		ConnChan: make(chan net.Conn, 128),
+		ErrChan:  make(chan error, 1),
+	}
+
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs.Server = grpc.NewServer(opts...)
+	gs.Server.RegisterService(&gunServiceDesc, gs)
+	return gs
+}
+
+// Serve runs the gRPC server on ln and blocks until it's stopped; the relay
+// calls it directly from listenGRPC, the same way listenMWSS blocks on
+// MWSSServer's HTTP server, while its accept loop runs in a goroutine.
+func (gs *GRPCServer) Serve(ln net.Listener) error {
+	return gs.Server.Serve(ln)
+}
+
+func (gs *GRPCServer) handleTun(stream grpc.ServerStream) error {
+	if atomic.LoadInt32(&gs.closed) == 1 {
+		return errTransporterClosing
+	}
+
+	var remote net.Addr
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr
+	}
+
+	conn := newGRPCServerStreamConn(stream, remote)
+	select {
+	case gs.ConnChan <- conn:
+	default:
+		logger.Logger.Info("[grpc] connection queue is full")
+		return errTransporterClosing
+	}
+
+	// block until the relay's dispatch loop is done with conn, otherwise
+	// returning here would end the RPC out from under it.
+	<-conn.closed
+	return nil
+}
+
+// Accept mirrors MWSSServer.Accept so the relay's dispatch loop can treat
+// both the same way.
+func (gs *GRPCServer) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-gs.ConnChan:
+	case err = <-gs.ErrChan:
+	}
+	return
+}
+
+func (gs *GRPCServer) Close() error {
+	atomic.StoreInt32(&gs.closed, 1)
+	gs.Server.Stop()
+	return nil
+}
+
+// Shutdown marks gs as draining so handleTun rejects new streams, then lets
+// GracefulStop wait for in-flight RPCs (each blocked on <-conn.closed until
+// the relay's dispatch loop is done with it) to finish on their own. Unlike
+// GracefulStop alone, this is bounded by ctx: if it fires first, the server
+// is hard-stopped instead of hanging past graceShutdownTimeout, mirroring
+// MWSSServer.Shutdown on the mwss listen side.
+func (gs *GRPCServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&gs.closed, 1)
+
+	done := make(chan struct{})
+	go func() {
+		gs.Server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		gs.Server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,321 @@
+package transporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/logger"
+	"github.com/Ehco1996/ehco/internal/web"
+)
+
+// SessionPoolConfig are the knobs a RelayConfig can override; zero values
+// fall back to DefaultSessionPoolConfig.
+type SessionPoolConfig struct {
+	// MinIdle is the number of live sessions keepaliveLoop tries to keep
+	// warm per (addr, proto) key once that key has been dialed at least
+	// once (capped at MaxIdle). It does nothing for a key Get has never
+	// seen, since there's no addr to dial proactively before then.
+	MinIdle              int
+	MaxIdle              int
+	MaxStreamsPerSession int
+
+	// KeepAliveInterval and KeepAliveTimeout are handed straight to smux's
+	// own Config.KeepAliveInterval/KeepAliveTimeout on the client side (see
+	// mwssTransporter.initSession; MWSSServer.mux keeps smux's defaults) and
+	// also set
+	// checkAll's sweep cadence, so a session that's gone silent gets closed
+	// by smux itself instead of this pool trying to probe RTT on its own —
+	// smux.Session has no Ping method to probe with. checkAll only has to
+	// evict whatever smux has already marked IsClosed.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+var DefaultSessionPoolConfig = SessionPoolConfig{
+	MinIdle:              1,
+	MaxIdle:              4,
+	MaxStreamsPerSession: constant.MaxMWSSStreamCnt,
+	KeepAliveInterval:    30 * time.Second,
+	KeepAliveTimeout:     90 * time.Second,
+}
+
+func (c SessionPoolConfig) withDefaults() SessionPoolConfig {
+	d := DefaultSessionPoolConfig
+	if c.MinIdle > 0 {
+		d.MinIdle = c.MinIdle
+	}
+	if c.MaxIdle > 0 {
+		d.MaxIdle = c.MaxIdle
+	}
+	if c.MaxStreamsPerSession > 0 {
+		d.MaxStreamsPerSession = c.MaxStreamsPerSession
+	}
+	if c.KeepAliveInterval > 0 {
+		d.KeepAliveInterval = c.KeepAliveInterval
+	}
+	if c.KeepAliveTimeout > 0 {
+		d.KeepAliveTimeout = c.KeepAliveTimeout
+	}
+	return d
+}
+
+// addrPool is the per-(addr,proto) sub-pool: its own lock so a slow dial to
+// one remote never blocks Dial for another.
+type addrPool struct {
+	mu       sync.Mutex
+	sessions []*muxSession
+}
+
+// dialFunc opens a brand new session for key; it's supplied by the caller
+// (mwssTransporter.initSession) so SessionPool stays transport-agnostic.
+type dialFunc func(key sessionKey) (*muxSession, error)
+
+// SessionPool replaces the single global-mutex, first-fit session map with
+// per-address locking, weighted least-loaded selection, and a background
+// keepalive/eviction loop.
+type SessionPool struct {
+	cfg  SessionPoolConfig
+	dial dialFunc
+
+	mu       sync.RWMutex
+	pools    map[sessionKey]*addrPool
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func NewSessionPool(cfg SessionPoolConfig, dial dialFunc) *SessionPool {
+	p := &SessionPool{
+		cfg:    cfg.withDefaults(),
+		dial:   dial,
+		pools:  make(map[sessionKey]*addrPool),
+		stopCh: make(chan struct{}),
+	}
+	go p.keepaliveLoop()
+	return p
+}
+
+func (p *SessionPool) addrPoolFor(key sessionKey) *addrPool {
+	p.mu.RLock()
+	ap, ok := p.pools[key]
+	p.mu.RUnlock()
+	if ok {
+		return ap
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ap, ok = p.pools[key]; ok {
+		return ap
+	}
+	ap = &addrPool{}
+	p.pools[key] = ap
+	return ap
+}
+
+// Get returns a conn-yielding session for key, picking the least-loaded
+// live session with headroom (by NumStreams()/MaxStreamsPerSession). When no
+// session has headroom it dials a new one while fewer than MaxIdle sessions
+// are open, and otherwise reuses the least-loaded non-draining session.
+func (p *SessionPool) Get(key sessionKey) (*muxSession, error) {
+	ap := p.addrPoolFor(key)
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.sessions = evictClosed(ap.sessions)
+
+	if best := leastLoaded(ap.sessions, p.cfg.MaxStreamsPerSession); best != nil {
+		return best, nil
+	}
+
+	if len(ap.sessions) >= p.cfg.MaxIdle {
+		// still over budget: reuse the least loaded one even though it's
+		// already at its stream cap, rather than unbounded growth.
+		if best := leastLoadedAny(ap.sessions); best != nil {
+			return best, nil
+		}
+	}
+
+	session, err := p.dial(key)
+	if err != nil {
+		web.IncTransporterStreamOpenFailures()
+		return nil, err
+	}
+	web.IncTransporterDials()
+	ap.sessions = append(ap.sessions, session)
+	return session, nil
+}
+
+func evictClosed(sessions []*muxSession) []*muxSession {
+	live := sessions[:0]
+	for _, s := range sessions {
+		if s.IsClosed() {
+			web.IncTransporterEvictions()
+			continue
+		}
+		live = append(live, s)
+	}
+	return live
+}
+
+// leastLoaded returns the session with the lowest NumStreams()/max ratio
+// among sessions that still have headroom, or nil if none do.
+func leastLoaded(sessions []*muxSession, max int) *muxSession {
+	var best *muxSession
+	bestLoad := 1.0
+	for _, s := range sessions {
+		if s.draining || s.NumStreams() >= s.maxStreamCnt {
+			continue
+		}
+		load := float64(s.NumStreams()) / float64(max)
+		if best == nil || load < bestLoad {
+			best, bestLoad = s, load
+		}
+	}
+	return best
+}
+
+func leastLoadedAny(sessions []*muxSession) *muxSession {
+	var best *muxSession
+	for _, s := range sessions {
+		if s.draining {
+			continue
+		}
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	return best
+}
+
+func (p *SessionPool) keepaliveLoop() {
+	ticker := time.NewTicker(p.cfg.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			p.checkAll()
+		}
+	}
+}
+
+func (p *SessionPool) checkAll() {
+	p.mu.RLock()
+	type keyedPool struct {
+		key sessionKey
+		ap  *addrPool
+	}
+	pools := make([]keyedPool, 0, len(p.pools))
+	for key, ap := range p.pools {
+		pools = append(pools, keyedPool{key: key, ap: ap})
+	}
+	p.mu.RUnlock()
+
+	for _, kp := range pools {
+		ap := kp.ap
+		ap.mu.Lock()
+		ap.sessions = evictClosed(ap.sessions)
+		ap.mu.Unlock()
+
+		p.warmIdle(kp.key, ap)
+	}
+}
+
+// warmIdle tops ap back up to MinIdle (capped at MaxIdle) by proactively
+// dialing new sessions, so a key that's already seen traffic keeps a warm
+// session around instead of the next caller paying a fresh dial's latency.
+// A key that hasn't been dialed at least once by Get has no addrPool yet and
+// so isn't warmed until it has; SessionPool has no remote addr to dial
+// otherwise.
+func (p *SessionPool) warmIdle(key sessionKey, ap *addrPool) {
+	target := p.cfg.MinIdle
+	if target > p.cfg.MaxIdle {
+		target = p.cfg.MaxIdle
+	}
+
+	for {
+		ap.mu.Lock()
+		n := len(ap.sessions)
+		ap.mu.Unlock()
+		if n >= target {
+			return
+		}
+
+		session, err := p.dial(key)
+		if err != nil {
+			web.IncTransporterStreamOpenFailures()
+			logger.Logger.Infof("[mwss] warm pool dial %v err: %s", key, err)
+			return
+		}
+		web.IncTransporterDials()
+
+		ap.mu.Lock()
+		ap.sessions = append(ap.sessions, session)
+		ap.mu.Unlock()
+	}
+}
+
+func (p *SessionPool) Close() error {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ap := range p.pools {
+		ap.mu.Lock()
+		for _, s := range ap.sessions {
+			s.Close()
+		}
+		ap.mu.Unlock()
+	}
+	return nil
+}
+
+// Shutdown marks every live session as draining, so Get stops handing out
+// new streams from them, then waits for each to reach NumStreams()==0
+// before closing it (bounded by ctx; anything still open when ctx expires
+// is closed anyway). Mirrors the closed-flag drain pattern used by
+// MWSSServer.Shutdown on the server side.
+func (p *SessionPool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+
+	p.mu.RLock()
+	var sessions []*muxSession
+	for _, ap := range p.pools {
+		ap.mu.Lock()
+		for _, s := range ap.sessions {
+			s.draining = true
+			sessions = append(sessions, s)
+		}
+		ap.mu.Unlock()
+	}
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *muxSession) {
+			defer wg.Done()
+			drainSession(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// drainSession waits for s to finish its in-flight streams (bounded by ctx)
+// before closing it.
+func drainSession(ctx context.Context, s *muxSession) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.NumStreams() > 0 {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+	s.Close()
+}
@@ -0,0 +1,110 @@
+package transporter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+// newTestSession wires up a real smux session pair over a net.Pipe so
+// NumStreams()/IsClosed() behave exactly as they do against a live mwss
+// conn, without needing a network.
+func newTestSession(t *testing.T, maxStreamCnt int) (ms *muxSession, cleanup func()) {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	cfg := smux.DefaultConfig()
+
+	cliSess, err := smux.Client(c1, cfg)
+	if err != nil {
+		t.Fatalf("smux.Client: %v", err)
+	}
+	srvSess, err := smux.Server(c2, cfg)
+	if err != nil {
+		t.Fatalf("smux.Server: %v", err)
+	}
+	go func() {
+		for {
+			if _, err := srvSess.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ms = &muxSession{conn: c1, session: cliSess, maxStreamCnt: maxStreamCnt, proto: "tcp"}
+	return ms, func() {
+		cliSess.Close()
+		srvSess.Close()
+	}
+}
+
+func openStreams(t *testing.T, ms *muxSession, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := ms.session.OpenStream(); err != nil {
+			t.Fatalf("OpenStream: %v", err)
+		}
+	}
+}
+
+func TestLeastLoadedPicksLightestWithHeadroom(t *testing.T) {
+	const max = 4
+
+	full, cleanupFull := newTestSession(t, max)
+	defer cleanupFull()
+	openStreams(t, full, max)
+
+	light, cleanupLight := newTestSession(t, max)
+	defer cleanupLight()
+	openStreams(t, light, 1)
+
+	draining, cleanupDraining := newTestSession(t, max)
+	defer cleanupDraining()
+	draining.draining = true
+
+	got := leastLoaded([]*muxSession{full, draining, light}, max)
+	if got != light {
+		t.Fatalf("leastLoaded picked %v, want the lightly loaded session", got)
+	}
+}
+
+func TestLeastLoadedNilWhenNoneHaveHeadroom(t *testing.T) {
+	const max = 2
+
+	s, cleanup := newTestSession(t, max)
+	defer cleanup()
+	openStreams(t, s, max)
+
+	if got := leastLoaded([]*muxSession{s}, max); got != nil {
+		t.Fatalf("leastLoaded = %v, want nil when every session is full", got)
+	}
+}
+
+func TestLeastLoadedAnySkipsDraining(t *testing.T) {
+	busy, cleanupBusy := newTestSession(t, 4)
+	defer cleanupBusy()
+	openStreams(t, busy, 2)
+
+	draining, cleanupDraining := newTestSession(t, 4)
+	defer cleanupDraining()
+	draining.draining = true
+
+	got := leastLoadedAny([]*muxSession{draining, busy})
+	if got != busy {
+		t.Fatalf("leastLoadedAny picked %v, want the non-draining session", got)
+	}
+}
+
+func TestEvictClosedDropsOnlyClosedSessions(t *testing.T) {
+	live, cleanupLive := newTestSession(t, 4)
+	defer cleanupLive()
+
+	closed, cleanupClosed := newTestSession(t, 4)
+	cleanupClosed()
+
+	got := evictClosed([]*muxSession{live, closed})
+	if len(got) != 1 || got[0] != live {
+		t.Fatalf("evictClosed = %v, want only the live session", got)
+	}
+}
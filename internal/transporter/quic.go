@@ -0,0 +1,80 @@
+package transporter
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+)
+
+// quicStreamConn adapts a *quic.Stream, which already behaves like a
+// net.Conn save for addressing, onto the real interface.
+type quicStreamConn struct {
+	*quic.Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.local }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.remote }
+
+// quicTransporter opens one QUIC connection per remote addr and a new
+// bidirectional stream per Dial, the same multiplexing shape as mwss's smux
+// sessions but without needing a TCP+TLS+WS handshake underneath.
+type quicTransporter struct {
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+}
+
+func NewQUICTransporter() *quicTransporter {
+	return &quicTransporter{conns: make(map[string]*quic.Conn)}
+}
+
+func (tr *quicTransporter) connFor(addr string) (*quic.Conn, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if c, ok := tr.conns[addr]; ok {
+		return c, nil
+	}
+	c, err := quic.DialAddr(context.Background(), addr, mytls.DefaultTLSConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	tr.conns[addr] = c
+	return c, nil
+}
+
+func (tr *quicTransporter) Dial(addr, proto string) (net.Conn, error) {
+	c, err := tr.connFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, local: c.LocalAddr(), remote: c.RemoteAddr()}, nil
+}
+
+func (tr *quicTransporter) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var firstErr error
+	for addr, c := range tr.conns {
+		if err := c.CloseWithError(0, "closing"); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(tr.conns, addr)
+	}
+	return firstErr
+}
+
+func (tr *quicTransporter) Name() string      { return "quic" }
+func (tr *quicTransporter) Multiplexes() bool { return true }
+
+func init() {
+	Register("quic", func(Options) Transporter { return NewQUICTransporter() })
+}
@@ -0,0 +1,19 @@
+package transporter
+
+import "net"
+
+// rawTransporter dials a plain, unmuxed connection per request. It backs the
+// historical "raw" transport type.
+type rawTransporter struct{}
+
+func NewRawTransporter() *rawTransporter {
+	return &rawTransporter{}
+}
+
+func (tr *rawTransporter) Dial(addr, proto string) (net.Conn, error) {
+	return net.Dial(proto, addr)
+}
+
+func (tr *rawTransporter) Close() error      { return nil }
+func (tr *rawTransporter) Name() string      { return "raw" }
+func (tr *rawTransporter) Multiplexes() bool { return false }
@@ -0,0 +1,68 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+)
+
+// Transporter is the full contract a stream carrier registers against: it
+// can dial, it can be torn down, it can name itself for logs/config, and it
+// declares whether it natively multiplexes so the relay can skip layering
+// its own smux on top of an already-multiplexed carrier (e.g. gRPC's
+// HTTP/2 streams).
+type Transporter interface {
+	Dialer
+	Close() error
+	Name() string
+	Multiplexes() bool
+}
+
+// GracefulCloser is implemented by transporters that can drain in-flight
+// streams before tearing down, instead of slamming every conn shut. Backends
+// without meaningful in-flight state (raw, per-request gRPC/QUIC streams)
+// can skip it; callers fall back to plain Close.
+type GracefulCloser interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Options is the union of knobs any registered transporter might need. Each
+// backend reads only the fields it cares about.
+type Options struct {
+	MuxOnly constant.MuxScope
+	Pool    SessionPoolConfig
+}
+
+type Factory func(Options) Transporter
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register adds a transporter backend under name, overwriting any prior
+// registration. Backends call this from an init() in their own file, the
+// same way v2ray/xray-core's outbound handlers self-register.
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = f
+}
+
+// New looks up name in the registry and constructs it with opts.
+func New(name string, opts Options) (Transporter, error) {
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("transporter: no backend registered for %q", name)
+	}
+	return f(opts), nil
+}
+
+func init() {
+	Register("raw", func(Options) Transporter { return NewRawTransporter() })
+	Register("mwss", func(o Options) Transporter { return NewMWSSTransporterWithPoolConfig(o.MuxOnly, o.Pool) })
+}
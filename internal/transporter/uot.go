@@ -0,0 +1,350 @@
+package transporter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+
+	"github.com/Ehco1996/ehco/internal/logger"
+)
+
+// uotIdleTimeout is how long a binding can go without forwarding a datagram
+// in either direction before uotServer's sweep evicts it and closes its UDP
+// socket. A dead/errored pump stops touching the binding, so it gets swept
+// on the same schedule as one that's simply gone quiet.
+const uotIdleTimeout = 2 * time.Minute
+
+// globalID identifies a single UDP flow across reconnects, derived
+// deterministically from the flow's 5-tuple so a client that loses its WSS
+// connection and redials regenerates the same ID, letting the server rebind
+// the flow to the new stream instead of allocating a new UDP socket.
+type globalID [8]byte
+
+// newGlobalID hashes {srcIP, srcPort, dstIP, dstPort} with FNV-64a. The
+// proto isn't included on purpose: a UoT tunnel only ever carries UDP.
+func newGlobalID(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) globalID {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d>%s:%d", srcIP.String(), srcPort, dstIP.String(), dstPort)
+	var id globalID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// uotFrame is the on-the-wire record written to a smux stream carrying UoT
+// traffic: globalID(8) | dstAddrLen(2) | dstAddr | payloadLen(4) | payload.
+type uotFrame struct {
+	id      globalID
+	dstAddr string
+	payload []byte
+}
+
+func writeUoTFrame(w io.Writer, f *uotFrame) error {
+	if _, err := w.Write(f.id[:]); err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint16(lenBuf[:2], uint16(len(f.dstAddr)))
+	if _, err := w.Write(lenBuf[:2]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, f.dstAddr); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(lenBuf[:4], uint32(len(f.payload)))
+	if _, err := w.Write(lenBuf[:4]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+func readUoTFrame(r io.Reader) (*uotFrame, error) {
+	f := &uotFrame{}
+	if _, err := io.ReadFull(r, f.id[:]); err != nil {
+		return nil, err
+	}
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:2]); err != nil {
+		return nil, err
+	}
+	addrBuf := make([]byte, binary.BigEndian.Uint16(lenBuf[:2]))
+	if _, err := io.ReadFull(r, addrBuf); err != nil {
+		return nil, err
+	}
+	f.dstAddr = string(addrBuf)
+	if _, err := io.ReadFull(r, lenBuf[:4]); err != nil {
+		return nil, err
+	}
+	f.payload = make([]byte, binary.BigEndian.Uint32(lenBuf[:4]))
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// uotBinding is the server-side state for one migrating UDP flow: the real
+// socket to the destination, and whichever smux stream is currently
+// forwarding for it. Only one goroutine ever reads udp (started once, by the
+// first rebind) so migration can never race two readers over the same
+// *net.UDPConn; the stream direction instead swaps which stream udp's
+// datagrams get framed onto, guarded by mu.
+type uotBinding struct {
+	mu       sync.Mutex
+	id       globalID
+	srv      *uotServer
+	udp      *net.UDPConn
+	stream   *smux.Stream
+	pumpOnce sync.Once
+
+	// lastActive is a UnixNano timestamp, touched on every datagram forwarded
+	// in either direction, so uotServer's sweep can tell an idle binding from
+	// a busy one.
+	lastActive int64
+}
+
+func (b *uotBinding) touch() {
+	atomic.StoreInt64(&b.lastActive, time.Now().UnixNano())
+}
+
+func (b *uotBinding) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&b.lastActive)))
+}
+
+// close tears down the binding's UDP socket and, if a stream is currently
+// bound, that too, unblocking whatever pump is reading it.
+func (b *uotBinding) close() {
+	b.mu.Lock()
+	stream := b.stream
+	b.mu.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+	b.udp.Close()
+}
+
+// remove deletes b from its owning uotServer's map and decrements liveCount,
+// but only if b is still the binding registered under its id — a no-op if
+// evictIdle (or an earlier call) already removed it. Called by
+// pumpUDPToStream when it returns for good, since that's the single
+// long-lived reader whose death means the binding is truly dead, not just
+// mid-rebind.
+func (b *uotBinding) remove() {
+	if b.srv == nil {
+		return
+	}
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	if cur, ok := b.srv.bindings[b.id]; ok && cur == b {
+		delete(b.srv.bindings, b.id)
+		atomic.AddInt64(&b.srv.liveCount, -1)
+	}
+}
+
+// uotServer tracks in-flight UoT flows by globalID so a stream arriving on a
+// brand new mwss session (after the client reconnected) can be rebound to
+// the existing UDP socket instead of opening a new one. A background sweep
+// evicts bindings that have gone idle (or whose pumps died without anyone
+// noticing), so a long-running server doesn't leak one UDP socket per flow
+// it has ever seen.
+type uotServer struct {
+	mu       sync.Mutex
+	bindings map[globalID]*uotBinding
+
+	// liveCount mirrors len(bindings), kept as its own atomic so
+	// MWSSServer.Shutdown can poll it without taking mu.
+	liveCount int64
+}
+
+func newUoTServer() *uotServer {
+	u := &uotServer{bindings: make(map[globalID]*uotBinding)}
+	go u.evictIdleLoop()
+	return u
+}
+
+// liveBindings reports how many UDP flows this server is currently pumping,
+// so MWSSServer.Shutdown's drain loop can wait for them the same way it waits
+// on outstanding/ConnChan for non-UoT conns.
+func (u *uotServer) liveBindings() int64 {
+	return atomic.LoadInt64(&u.liveCount)
+}
+
+func (u *uotServer) evictIdleLoop() {
+	ticker := time.NewTicker(uotIdleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.evictIdle()
+	}
+}
+
+func (u *uotServer) evictIdle() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, b := range u.bindings {
+		if b.idleFor() > uotIdleTimeout {
+			logger.Logger.Infof("[mwss uot] evicting idle binding %x", id)
+			b.close()
+			delete(u.bindings, id)
+			atomic.AddInt64(&u.liveCount, -1)
+		}
+	}
+}
+
+// handleStream reads the leading frame off stream to learn the flow's
+// globalID and destination, then either rebinds an existing UDP socket to
+// this stream or dials a fresh one, and pumps datagrams between them until
+// either side closes.
+func (u *uotServer) handleStream(stream *smux.Stream) {
+	first, err := readUoTFrame(stream)
+	if err != nil {
+		logger.Logger.Infof("[mwss uot] read first frame err: %s", err)
+		stream.Close()
+		return
+	}
+
+	u.mu.Lock()
+	b, ok := u.bindings[first.id]
+	if !ok {
+		udpConn, err := net.Dial("udp", first.dstAddr)
+		if err != nil {
+			u.mu.Unlock()
+			logger.Logger.Infof("[mwss uot] dial udp remote %s err: %s", first.dstAddr, err)
+			stream.Close()
+			return
+		}
+		b = &uotBinding{id: first.id, srv: u, udp: udpConn.(*net.UDPConn)}
+		b.touch()
+		u.bindings[first.id] = b
+		atomic.AddInt64(&u.liveCount, 1)
+	}
+	u.mu.Unlock()
+
+	b.rebind(stream, first.payload)
+}
+
+// rebind swaps the stream a binding pumps through. The old stream, if any,
+// is closed so its in-flight blocking read in pumpStreamToUDP unblocks with
+// an error right away instead of racing the new stream's reader; the single
+// long-lived pumpUDPToStream goroutine is left alone (started at most once,
+// by the first rebind) and just picks up the new stream via b.stream.
+func (b *uotBinding) rebind(stream *smux.Stream, seed []byte) {
+	b.mu.Lock()
+	old := b.stream
+	b.stream = stream
+	udp := b.udp
+	b.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	if len(seed) > 0 {
+		if _, err := udp.Write(seed); err != nil {
+			logger.Logger.Infof("[mwss uot] write to udp remote err: %s", err)
+		}
+	}
+
+	go b.pumpStreamToUDP(stream)
+	b.pumpOnce.Do(func() { go b.pumpUDPToStream() })
+}
+
+func (b *uotBinding) pumpStreamToUDP(stream *smux.Stream) {
+	for {
+		frame, err := readUoTFrame(stream)
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		isCurrent := b.stream == stream
+		b.mu.Unlock()
+		if !isCurrent {
+			// rebind already closed this stream and started a newer pump;
+			// drop whatever frame raced in just before that.
+			return
+		}
+
+		if _, err := b.udp.Write(frame.payload); err != nil {
+			return
+		}
+		b.touch()
+	}
+}
+
+// pumpUDPToStream is the single, long-lived reader of b.udp for this
+// binding's whole lifetime: it re-reads b.stream on every datagram instead
+// of being handed one at spawn time, so a rebind can redirect it without
+// ever needing a second goroutine to read the same UDPConn.
+func (b *uotBinding) pumpUDPToStream() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := b.udp.Read(buf)
+		if err != nil {
+			b.remove()
+			return
+		}
+
+		b.mu.Lock()
+		stream := b.stream
+		b.mu.Unlock()
+		if stream == nil {
+			continue
+		}
+		if err := writeUoTFrame(stream, &uotFrame{payload: buf[:n]}); err != nil {
+			// the stream that was current when we read this datagram broke;
+			// drop it and wait for the next rebind to land a fresh stream.
+			continue
+		}
+		b.touch()
+	}
+}
+
+// uotConn adapts a muxConn carrying UoT traffic to net.Conn semantics for
+// callers on the client side: Write frames outgoing datagrams with the
+// flow's globalID and dst addr, Read unwraps incoming ones back to raw
+// payload bytes.
+type uotConn struct {
+	net.Conn
+	id      globalID
+	dstAddr string
+}
+
+// DialUoT opens (or reuses, via tr's session pool) a mwss stream to addr and
+// wraps it so UDP datagrams between srcAddr and dstAddr survive WSS
+// reconnects: redialing regenerates the same globalID, so the server-side
+// uotServer rebinds the existing UDP socket to the new stream. tr takes the
+// Dialer interface rather than *mwssTransporter so callers outside this
+// package (the relay's accept loop) can invoke it against whatever
+// Transporter they were handed.
+func DialUoT(tr Dialer, addr string, srcAddr, dstAddr *net.UDPAddr) (net.Conn, error) {
+	conn, err := tr.Dial(addr, "udp")
+	if err != nil {
+		return nil, err
+	}
+	return &uotConn{
+		Conn:    conn,
+		id:      newGlobalID(srcAddr.IP, srcAddr.Port, dstAddr.IP, dstAddr.Port),
+		dstAddr: dstAddr.String(),
+	}, nil
+}
+
+func (c *uotConn) Write(b []byte) (int, error) {
+	if err := writeUoTFrame(c.Conn, &uotFrame{id: c.id, dstAddr: c.dstAddr, payload: b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *uotConn) Read(b []byte) (int, error) {
+	frame, err := readUoTFrame(c.Conn)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, frame.payload), nil
+}
@@ -0,0 +1,68 @@
+package transporter
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNewGlobalIDDeterministic(t *testing.T) {
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("1.2.3.4")
+
+	a := newGlobalID(src, 1234, dst, 53)
+	b := newGlobalID(src, 1234, dst, 53)
+	if a != b {
+		t.Fatalf("newGlobalID is not deterministic: %x != %x", a, b)
+	}
+
+	c := newGlobalID(src, 5678, dst, 53)
+	if a == c {
+		t.Fatalf("newGlobalID(%d) and newGlobalID(%d) collided: %x", 1234, 5678, a)
+	}
+}
+
+func TestUoTFrameRoundTrip(t *testing.T) {
+	want := &uotFrame{
+		dstAddr: "1.2.3.4:53",
+		payload: []byte("hello uot"),
+	}
+	copy(want.id[:], "abcdefgh")
+
+	var buf bytes.Buffer
+	if err := writeUoTFrame(&buf, want); err != nil {
+		t.Fatalf("writeUoTFrame: %v", err)
+	}
+
+	got, err := readUoTFrame(&buf)
+	if err != nil {
+		t.Fatalf("readUoTFrame: %v", err)
+	}
+
+	if got.id != want.id {
+		t.Errorf("id = %x, want %x", got.id, want.id)
+	}
+	if got.dstAddr != want.dstAddr {
+		t.Errorf("dstAddr = %q, want %q", got.dstAddr, want.dstAddr)
+	}
+	if !bytes.Equal(got.payload, want.payload) {
+		t.Errorf("payload = %q, want %q", got.payload, want.payload)
+	}
+}
+
+func TestUoTFrameRoundTripEmptyPayload(t *testing.T) {
+	want := &uotFrame{dstAddr: "8.8.8.8:53"}
+
+	var buf bytes.Buffer
+	if err := writeUoTFrame(&buf, want); err != nil {
+		t.Fatalf("writeUoTFrame: %v", err)
+	}
+
+	got, err := readUoTFrame(&buf)
+	if err != nil {
+		t.Fatalf("readUoTFrame: %v", err)
+	}
+	if len(got.payload) != 0 {
+		t.Errorf("payload = %q, want empty", got.payload)
+	}
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// TransporterMetrics counts pool-level events for transporter.SessionPool.
+// It's deliberately a flat struct of counters rather than a histogram
+// library: the web server here is a lightweight status page, not a metrics
+// backend.
+type TransporterMetrics struct {
+	Dials              int64 `json:"dials"`
+	Evictions          int64 `json:"evictions"`
+	StreamOpenFailures int64 `json:"stream_open_failures"`
+}
+
+var transporterMetrics TransporterMetrics
+
+func IncTransporterDials()              { atomic.AddInt64(&transporterMetrics.Dials, 1) }
+func IncTransporterEvictions()          { atomic.AddInt64(&transporterMetrics.Evictions, 1) }
+func IncTransporterStreamOpenFailures() { atomic.AddInt64(&transporterMetrics.StreamOpenFailures, 1) }
+
+func snapshotTransporterMetrics() TransporterMetrics {
+	return TransporterMetrics{
+		Dials:              atomic.LoadInt64(&transporterMetrics.Dials),
+		Evictions:          atomic.LoadInt64(&transporterMetrics.Evictions),
+		StreamOpenFailures: atomic.LoadInt64(&transporterMetrics.StreamOpenFailures),
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshotTransporterMetrics())
+}
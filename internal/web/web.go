@@ -0,0 +1,16 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/Ehco1996/ehco/internal/logger"
+)
+
+// StartWebServer serves the small status/metrics page used for local
+// debugging and monitoring of a running ehco instance.
+func StartWebServer(port string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	logger.Logger.Infof("[web] start web server on port: %s", port)
+	return http.ListenAndServe(":"+port, mux)
+}